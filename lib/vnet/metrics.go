@@ -0,0 +1,139 @@
+// Teleport
+// Copyright (C) 2024 Gravitational, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vnet
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const metricsNamespace = "teleport_vnet"
+
+const (
+	directionToTUN   = "to_tun"
+	directionFromTUN = "from_tun"
+)
+
+// Metrics holds the set of Prometheus collectors a VNet [Manager] exposes for diagnosing
+// throughput and latency problems on the TUN<->netstack data path.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	tunBytesTotal   *prometheus.CounterVec
+	tunPacketsTotal *prometheus.CounterVec
+
+	inFlightTCPConns prometheus.Gauge
+
+	tcpHandlerDuration    prometheus.Histogram
+	connectorSetupLatency prometheus.Histogram
+	assignHandlerLatency  prometheus.Histogram
+
+	netstackReadQueueDepth prometheus.Gauge
+
+	droppedTCPRequestsTotal prometheus.Counter
+}
+
+func newMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+
+	m := &Metrics{
+		registry: registry,
+		tunBytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tun_bytes_total",
+			Help:      "Total bytes copied between the TUN device and the netstack, labeled by direction and IP version.",
+		}, []string{"direction", "ip_version"}),
+		tunPacketsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tun_packets_total",
+			Help:      "Total packets copied between the TUN device and the netstack, labeled by direction and IP version.",
+		}, []string{"direction", "ip_version"}),
+		inFlightTCPConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tcp_in_flight_connections",
+			Help:      "Number of TCP connections currently being handled, counted until the handler returns; unlike maxInFlightTCPConnectionAttempts, this includes connections whose setup has completed.",
+		}),
+		tcpHandlerDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "tcp_handler_duration_seconds",
+			Help:      "Time spent inside a registered tcpHandler for a single connection.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		connectorSetupLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "tcp_connector_setup_duration_seconds",
+			Help:      "Time taken to create the gVisor TCP endpoint for an accepted connection.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		assignHandlerLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "assign_handler_duration_seconds",
+			Help:      "Time taken to allocate a VNet address and register a handler for it.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		netstackReadQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "netstack_read_queue_depth",
+			Help:      "Number of packets drained from the netstack link endpoint in the most recent batch, as a proxy for queue backlog.",
+		}),
+		droppedTCPRequestsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tcp_dropped_unknown_address_total",
+			Help:      "Total TCP connection requests reset because no handler was registered for the destination address.",
+		}),
+	}
+
+	registry.MustRegister(
+		m.tunBytesTotal,
+		m.tunPacketsTotal,
+		m.inFlightTCPConns,
+		m.tcpHandlerDuration,
+		m.connectorSetupLatency,
+		m.assignHandlerLatency,
+		m.netstackReadQueueDepth,
+		m.droppedTCPRequestsTotal,
+	)
+
+	return m
+}
+
+// MetricsHandler returns an [http.Handler] that serves this Manager's Prometheus metrics, suitable for
+// mounting on the tsh admin socket.
+func (m *Manager) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(m.metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) recordTUNPacket(direction string, protocol tcpip.NetworkProtocolNumber, bytes int) {
+	version := ipVersionLabel(protocol)
+	m.tunBytesTotal.WithLabelValues(direction, version).Add(float64(bytes))
+	m.tunPacketsTotal.WithLabelValues(direction, version).Inc()
+}
+
+func ipVersionLabel(protocol tcpip.NetworkProtocolNumber) string {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		return "4"
+	case header.IPv6ProtocolNumber:
+		return "6"
+	default:
+		return "unknown"
+	}
+}
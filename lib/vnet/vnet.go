@@ -19,11 +19,13 @@ package vnet
 import (
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/gravitational/trace"
 	"golang.org/x/sync/errgroup"
@@ -36,7 +38,9 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
 
 	"github.com/gravitational/teleport"
@@ -55,8 +59,24 @@ type Config struct {
 	TUNDevice TUNDevice
 	// IPv6Prefix is the IPv6 ULA prefix to use for all assigned VNet IP addresses.
 	IPv6Prefix tcpip.Address
+	// IPv4CIDR is the IPv4 CIDR range VNet will allocate assigned IPv4 addresses from. Legacy resolvers and
+	// applications that don't query AAAA records still need an IPv4 address to dial. Defaults to the CGNAT
+	// range 100.64.0.0/10, which is unlikely to collide with real networks the user is also connected to.
+	IPv4CIDR string
+	// Promiscuous puts the netstack into promiscuous mode, so that it captures packets addressed to any
+	// destination rather than only those matching an address added via AddProtocolAddress. This is required
+	// to use VNet as a transparent inspection point, e.g. to proxy all traffic for a DNS suffix without
+	// pre-registering every backend IP.
+	Promiscuous bool
+	// CatchAllTCPHandler, when set, handles TCP connections that don't match any address registered with
+	// [Manager.assignTCPHandler] or [Manager.assignTCPHandlerV4], instead of the connection being reset. It
+	// only has an effect when [Promiscuous] is enabled.
+	CatchAllTCPHandler catchAllTCPHandler
 }
 
+// defaultIPv4CIDR is the CGNAT range used for VNet's IPv4 address pool when [Config.IPv4CIDR] is unset.
+const defaultIPv4CIDR = "100.64.0.0/10"
+
 // CheckAndSetDefaults checks the config and sets defaults.
 func (c *Config) CheckAndSetDefaults() error {
 	if c.TUNDevice == nil {
@@ -65,6 +85,16 @@ func (c *Config) CheckAndSetDefaults() error {
 	if c.IPv6Prefix.Len() != 16 || c.IPv6Prefix.AsSlice()[0] != 0xfd {
 		return trace.BadParameter("IPv6Prefix must be an IPv6 ULA address")
 	}
+	if c.IPv4CIDR == "" {
+		c.IPv4CIDR = defaultIPv4CIDR
+	}
+	ip, _, err := net.ParseCIDR(c.IPv4CIDR)
+	if err != nil {
+		return trace.Wrap(err, "parsing IPv4CIDR")
+	}
+	if ip.To4() == nil {
+		return trace.BadParameter("IPv4CIDR %q must be an IPv4 CIDR", c.IPv4CIDR)
+	}
 	return nil
 }
 
@@ -130,6 +160,9 @@ type Manager struct {
 	// ipv6Prefix holds the 96-bit prefix that will be used for all IPv6 addresses assigned in the VNet.
 	ipv6Prefix tcpip.Address
 
+	// ipv4Net holds the IPv4 CIDR range that VNet-assigned IPv4 addresses are allocated from.
+	ipv4Net *net.IPNet
+
 	// destroyed is a channel that will be closed when the VNet is in the process of being destroyed.
 	// All goroutines should terminate quickly after either this is closed or the context passed to
 	// [Manager.Run] is canceled.
@@ -141,27 +174,57 @@ type Manager struct {
 	// be optimized as necessary.
 	state state
 
+	// metrics holds the Prometheus collectors exposed via [Manager.MetricsHandler].
+	metrics *Metrics
+
+	// catchAllTCPHandler, if set, handles TCP connections that don't match any registered address. It only
+	// has an effect when promiscuous is true, matching [Config.CatchAllTCPHandler]'s doc comment.
+	catchAllTCPHandler catchAllTCPHandler
+	// promiscuous mirrors [Config.Promiscuous], gating catchAllTCPHandler above.
+	promiscuous bool
+
 	slog *slog.Logger
 }
 
 type state struct {
-	mu                   sync.RWMutex
-	tcpHandlers          map[tcpip.Address]tcpHandler
-	lastAssignedIPSuffix uint32
+	mu                     sync.RWMutex
+	tcpHandlers            map[tcpip.Address]tcpHandler
+	udpHandlers            map[tcpip.Address]udpHandler
+	lastAssignedIPSuffix   uint32
+	tcpHandlersV4          map[tcpip.Address]tcpHandler
+	lastAssignedIPv4Suffix uint32
 }
 
 func newState() state {
 	return state{
 		tcpHandlers: make(map[tcpip.Address]tcpHandler),
+		udpHandlers: make(map[tcpip.Address]udpHandler),
 		// Suffix 0 is reserved, suffix 1 is assigned to the NIC.
 		lastAssignedIPSuffix: 1,
+		tcpHandlersV4:        make(map[tcpip.Address]tcpHandler),
+		// Suffix 0 is the IPv4 network address, it is never assigned.
+		lastAssignedIPv4Suffix: 0,
 	}
 }
 
-// tcpConnector is a type of function that can be called to consume a TCP connection.
-type tcpConnector func() (io.ReadWriteCloser, error)
+// TCPConnector is a type of function that can be called to consume a TCP connection.
+type TCPConnector func() (io.ReadWriteCloser, error)
 type tcpHandler interface {
-	handleTCP(context.Context, tcpConnector) error
+	handleTCP(context.Context, TCPConnector) error
+}
+
+// udpHandler is the interface implemented by types that can handle a UDP flow terminated at a VNet-assigned
+// address. Unlike [tcpHandler], the [gonet.UDPConn] is already connected by the time the handler is called,
+// there is no separate connector step.
+type udpHandler interface {
+	handleUDP(context.Context, *gonet.UDPConn, *net.UDPAddr) error
+}
+
+// catchAllTCPHandler is like [tcpHandler], but for a handler that isn't registered for any single address.
+// It additionally receives the original destination address and port of the connection so that it can
+// decide how to route or proxy it.
+type catchAllTCPHandler interface {
+	handleTCP(ctx context.Context, localAddr tcpip.Address, localPort uint16, connector TCPConnector) error
 }
 
 // NewManager creates a new VNet manager with the given configuration and root context. It takes ownership of
@@ -173,35 +236,50 @@ func NewManager(cfg *Config) (*Manager, error) {
 	}
 	slog := slog.With(teleport.ComponentKey, "VNet")
 
-	stack, linkEndpoint, err := createStack()
+	_, ipv4Net, err := net.ParseCIDR(cfg.IPv4CIDR)
+	if err != nil {
+		return nil, trace.Wrap(err, "parsing IPv4CIDR")
+	}
+
+	stack, linkEndpoint, err := createStack(cfg.Promiscuous)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 
-	if err := installVnetRoutes(stack); err != nil {
+	if err := installVnetRoutes(stack, ipv4Net); err != nil {
 		return nil, trace.Wrap(err)
 	}
 
 	m := &Manager{
-		tun:          cfg.TUNDevice,
-		stack:        stack,
-		linkEndpoint: linkEndpoint,
-		ipv6Prefix:   cfg.IPv6Prefix,
-		destroyed:    make(chan struct{}),
-		state:        newState(),
-		slog:         slog,
+		tun:                cfg.TUNDevice,
+		stack:              stack,
+		linkEndpoint:       linkEndpoint,
+		ipv6Prefix:         cfg.IPv6Prefix,
+		ipv4Net:            ipv4Net,
+		destroyed:          make(chan struct{}),
+		state:              newState(),
+		metrics:            newMetrics(),
+		catchAllTCPHandler: cfg.CatchAllTCPHandler,
+		promiscuous:        cfg.Promiscuous,
+		slog:               slog,
 	}
 
 	tcpForwarder := tcp.NewForwarder(m.stack, tcpReceiveBufferSize, maxInFlightTCPConnectionAttempts, m.handleTCP)
 	m.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
 
+	udpForwarder := udp.NewForwarder(m.stack, m.handleUDP)
+	m.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
 	return m, nil
 }
 
-func createStack() (*stack.Stack, *channel.Endpoint, error) {
+func createStack(promiscuous bool) (*stack.Stack, *channel.Endpoint, error) {
 	netStack := stack.New(stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv6.NewProtocol},
-		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv6.NewProtocol, ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		// HandleLocal makes the stack deliver packets sent to one of its own addresses internally. In
+		// promiscuous mode it is disabled so that every outbound packet is written to the NIC.
+		HandleLocal: !promiscuous,
 	})
 
 	const (
@@ -213,19 +291,40 @@ func createStack() (*stack.Stack, *channel.Endpoint, error) {
 		return nil, nil, trace.Errorf("creating VNet NIC: %s", err)
 	}
 
+	if promiscuous {
+		// Accept packets addressed to any destination, not only addresses added via AddProtocolAddress, and
+		// allow replies to be sent from those destination addresses.
+		if err := netStack.SetPromiscuousMode(nicID, true); err != nil {
+			return nil, nil, trace.Errorf("enabling promiscuous mode on VNet NIC: %s", err)
+		}
+		if err := netStack.SetSpoofing(nicID, true); err != nil {
+			return nil, nil, trace.Errorf("enabling spoofing on VNet NIC: %s", err)
+		}
+	}
+
 	return netStack, linkEndpoint, nil
 }
 
-func installVnetRoutes(stack *stack.Stack) error {
+func installVnetRoutes(stack *stack.Stack, ipv4Net *net.IPNet) error {
 	// Make the network stack pass all outbound IP packets to the NIC, regardless of destination IP address.
 	ipv6Subnet, err := tcpip.NewSubnet(tcpip.AddrFrom16([16]byte{}), tcpip.MaskFromBytes(make([]byte, 16)))
 	if err != nil {
 		return trace.Wrap(err, "creating VNet IPv6 subnet")
 	}
-	stack.SetRouteTable([]tcpip.Route{{
-		Destination: ipv6Subnet,
-		NIC:         nicID,
-	}})
+	ipv4Subnet, err := tcpip.NewSubnet(tcpip.AddrFromSlice(ipv4Net.IP.To4()), tcpip.MaskFromBytes(ipv4Net.Mask))
+	if err != nil {
+		return trace.Wrap(err, "creating VNet IPv4 subnet")
+	}
+	stack.SetRouteTable([]tcpip.Route{
+		{
+			Destination: ipv6Subnet,
+			NIC:         nicID,
+		},
+		{
+			Destination: ipv4Subnet,
+			NIC:         nicID,
+		},
+	})
 	return nil
 }
 
@@ -241,7 +340,7 @@ func (m *Manager) Run(ctx context.Context) error {
 	g.Go(func() error {
 		// Make sure to cancel the context in case this exits prematurely with a nil error.
 		defer cancel()
-		err := forwardBetweenTunAndNetstack(ctx, m.tun, m.linkEndpoint)
+		err := m.forwardBetweenTunAndNetstack(ctx)
 		allErrors <- err
 		return err
 	})
@@ -298,12 +397,18 @@ func (m *Manager) handleTCP(req *tcp.ForwarderRequest) {
 	defer slog.DebugContext(ctx, "Finished handling TCP connection.")
 
 	handler, ok := m.getTCPHandler(id.LocalAddress)
-	if !ok {
+	useCatchAll := !ok && m.promiscuous && m.catchAllTCPHandler != nil
+	if !ok && !useCatchAll {
 		slog.DebugContext(ctx, "No handler for address.", "addr", id.LocalAddress)
+		m.metrics.droppedTCPRequestsTotal.Inc()
 		return
 	}
 
+	m.metrics.inFlightTCPConns.Inc()
+	defer m.metrics.inFlightTCPConns.Dec()
+
 	connector := func() (io.ReadWriteCloser, error) {
+		connectorStart := time.Now()
 		var wq waiter.Queue
 		waitEntry, notifyCh := waiter.NewChannelEntry(waiter.EventErr | waiter.EventHUp)
 		wq.EventRegister(&waitEntry)
@@ -338,10 +443,19 @@ func (m *Manager) handleTCP(req *tcp.ForwarderRequest) {
 			conn.Close()
 		}()
 
+		m.metrics.connectorSetupLatency.Observe(time.Since(connectorStart).Seconds())
 		return conn, nil
 	}
 
-	if err := handler.handleTCP(ctx, connector); err != nil {
+	handlerStart := time.Now()
+	var err error
+	if ok {
+		err = handler.handleTCP(ctx, connector)
+	} else {
+		err = m.catchAllTCPHandler.handleTCP(ctx, id.LocalAddress, id.LocalPort, connector)
+	}
+	m.metrics.tcpHandlerDuration.Observe(time.Since(handlerStart).Seconds())
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.DebugContext(ctx, "TCP connection handler returned early due to canceled context.")
 		} else {
@@ -350,14 +464,91 @@ func (m *Manager) handleTCP(req *tcp.ForwarderRequest) {
 	}
 }
 
+func (m *Manager) handleUDP(req *udp.ForwarderRequest) {
+	// Add 1 to the waitgroup because the networking stack runs this in its own goroutine.
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id := req.ID()
+	slog := m.slog.With("request", id)
+	slog.DebugContext(ctx, "Handling UDP flow.")
+	defer slog.DebugContext(ctx, "Finished handling UDP flow.")
+
+	handler, ok := m.getUDPHandler(id.LocalAddress)
+	if !ok {
+		slog.DebugContext(ctx, "No UDP handler for address.", "addr", id.LocalAddress)
+		return
+	}
+
+	var wq waiter.Queue
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.EventErr | waiter.EventHUp)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	endpoint, err := req.CreateEndpoint(&wq)
+	if err != nil {
+		// This err doesn't actually implement [error]
+		slog.DebugContext(ctx, "Error creating UDP endpoint.", "err", err)
+		return
+	}
+
+	conn := gonet.NewUDPConn(&wq, endpoint)
+	defer conn.Close()
+
+	// done is closed when this function returns, to stop the watcher goroutine below from blocking forever
+	// on a flow that was never interrupted by HUP/ERR or VNet shutdown.
+	done := make(chan struct{})
+	defer close(done)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		select {
+		case <-done:
+			return
+		case <-notifyCh:
+			slog.DebugContext(ctx, "Got HUP or ERR, closing UDP conn.")
+		case <-m.destroyed:
+			slog.DebugContext(ctx, "VNet is being destroyed, closing UDP conn.")
+		}
+		cancel()
+		conn.Close()
+	}()
+
+	remoteAddr := &net.UDPAddr{
+		IP:   net.IP(id.RemoteAddress.AsSlice()),
+		Port: int(id.RemotePort),
+	}
+
+	if err := handler.handleUDP(ctx, conn, remoteAddr); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.DebugContext(ctx, "UDP flow handler returned early due to canceled context.")
+		} else {
+			slog.DebugContext(ctx, "Error handling UDP flow.", "err", err)
+		}
+	}
+}
+
+// getTCPHandler looks up the TCP handler registered for [addr], checking both the IPv6 and IPv4 handler
+// maps since [addr] may come from either address plane.
 func (m *Manager) getTCPHandler(addr tcpip.Address) (tcpHandler, bool) {
 	m.state.mu.RLock()
 	defer m.state.mu.RUnlock()
-	handler, ok := m.state.tcpHandlers[addr]
+	if handler, ok := m.state.tcpHandlers[addr]; ok {
+		return handler, true
+	}
+	handler, ok := m.state.tcpHandlersV4[addr]
 	return handler, ok
 }
 
 func (m *Manager) assignTCPHandler(handler tcpHandler) (tcpip.Address, error) {
+	defer func(start time.Time) {
+		m.metrics.assignHandlerLatency.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
 	m.state.mu.Lock()
 	defer m.state.mu.Unlock()
 
@@ -374,36 +565,115 @@ func (m *Manager) assignTCPHandler(handler tcpHandler) (tcpip.Address, error) {
 	return addr, nil
 }
 
-func forwardBetweenTunAndNetstack(ctx context.Context, tun TUNDevice, linkEndpoint *channel.Endpoint) error {
+// assignTCPHandlerV4 allocates the next available address from [m.ipv4Net] and registers [handler] to
+// handle all TCP connections to it.
+func (m *Manager) assignTCPHandlerV4(handler tcpHandler) (tcpip.Address, error) {
+	defer func(start time.Time) {
+		m.metrics.assignHandlerLatency.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+
+	m.state.lastAssignedIPv4Suffix++
+	ipSuffix := m.state.lastAssignedIPv4Suffix
+
+	addr, err := ipv4WithSuffix(m.ipv4Net, ipSuffix)
+	if err != nil {
+		return tcpip.Address{}, trace.Wrap(err)
+	}
+
+	m.state.tcpHandlersV4[addr] = handler
+	if err := m.addProtocolAddress(addr); err != nil {
+		return addr, trace.Wrap(err)
+	}
+
+	return addr, nil
+}
+
+func (m *Manager) getUDPHandler(addr tcpip.Address) (udpHandler, bool) {
+	m.state.mu.RLock()
+	defer m.state.mu.RUnlock()
+	handler, ok := m.state.udpHandlers[addr]
+	return handler, ok
+}
+
+func (m *Manager) assignUDPHandler(handler udpHandler) (tcpip.Address, error) {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+
+	m.state.lastAssignedIPSuffix++
+	ipSuffix := m.state.lastAssignedIPSuffix
+
+	addr := ipv6WithSuffix(m.ipv6Prefix, u32ToBytes(ipSuffix))
+
+	m.state.udpHandlers[addr] = handler
+	if err := m.addProtocolAddress(addr); err != nil {
+		return addr, trace.Wrap(err)
+	}
+
+	return addr, nil
+}
+
+func (m *Manager) forwardBetweenTunAndNetstack(ctx context.Context) error {
 	slog.DebugContext(ctx, "Forwarding IP packets between OS and VNet.")
 	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error { return forwardNetstackToTUN(ctx, linkEndpoint, tun) })
-	g.Go(func() error { return forwardTUNtoNetstack(tun, linkEndpoint) })
+	g.Go(func() error { return m.forwardNetstackToTUN(ctx, m.linkEndpoint, m.tun) })
+	g.Go(func() error { return m.forwardTUNtoNetstack(m.tun, m.linkEndpoint) })
 	return trace.Wrap(g.Wait())
 }
 
-func forwardNetstackToTUN(ctx context.Context, linkEndpoint *channel.Endpoint, tun TUNDevice) error {
-	bufs := [][]byte{make([]byte, device.MessageTransportHeaderSize+mtu)}
+func (m *Manager) forwardNetstackToTUN(ctx context.Context, linkEndpoint *channel.Endpoint, tun TUNDevice) error {
+	batchSize := tun.BatchSize()
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, device.MessageTransportHeaderSize+mtu)
+	}
+	protocols := make([]tcpip.NetworkProtocolNumber, batchSize)
 	for {
+		// Block until there's at least one packet to forward.
 		packet := linkEndpoint.ReadContext(ctx)
 		if packet.IsNil() {
 			// Nil packet is returned when context is canceled.
 			return trace.Wrap(ctx.Err())
 		}
-		offset := device.MessageTransportHeaderSize
-		for _, s := range packet.AsSlices() {
-			offset += copy(bufs[0][offset:], s)
+		n := 0
+		for {
+			protocols[n] = packet.NetworkProtocolNumber
+			bufs[n] = bufs[n][:writePacketToBuf(packet, bufs[n])]
+			packet.DecRef()
+			n++
+			if n >= batchSize {
+				break
+			}
+			// Opportunistically drain any packets that are already queued, without blocking, so that a
+			// single tun.Write call can carry a full batch.
+			if packet = linkEndpoint.Read(); packet.IsNil() {
+				break
+			}
 		}
-		packet.DecRef()
-		bufs[0] = bufs[0][:offset]
-		if _, err := tun.Write(bufs, device.MessageTransportHeaderSize); err != nil {
+		m.metrics.netstackReadQueueDepth.Set(float64(n))
+		if _, err := tun.Write(bufs[:n], device.MessageTransportHeaderSize); err != nil {
 			return trace.Wrap(err, "writing packets to TUN")
 		}
-		bufs[0] = bufs[0][:cap(bufs[0])]
+		for i := range bufs[:n] {
+			m.metrics.recordTUNPacket(directionToTUN, protocols[i], len(bufs[i])-device.MessageTransportHeaderSize)
+			bufs[i] = bufs[i][:cap(bufs[i])]
+		}
+	}
+}
+
+// writePacketToBuf copies all slices of [packet] into [buf] starting at the TUN device's transport header
+// offset and returns the total length written, including that offset.
+func writePacketToBuf(packet stack.PacketBufferPtr, buf []byte) int {
+	offset := device.MessageTransportHeaderSize
+	for _, s := range packet.AsSlices() {
+		offset += copy(buf[offset:], s)
 	}
+	return offset
 }
 
-func forwardTUNtoNetstack(tun TUNDevice, linkEndpoint *channel.Endpoint) error {
+func (m *Manager) forwardTUNtoNetstack(tun TUNDevice, linkEndpoint *channel.Endpoint) error {
 	const readOffset = device.MessageTransportHeaderSize
 	bufs := make([][]byte, tun.BatchSize())
 	for i := range bufs {
@@ -416,12 +686,21 @@ func forwardTUNtoNetstack(tun TUNDevice, linkEndpoint *channel.Endpoint) error {
 			return trace.Wrap(err, "reading packets from TUN")
 		}
 		for i := range sizes[:n] {
-			protocol, ok := protocolVersion(bufs[i][readOffset])
+			buf := bufs[i][readOffset : readOffset+sizes[i]]
+			protocol, ok := protocolVersion(buf[0])
 			if !ok {
 				continue
 			}
+			m.metrics.recordTUNPacket(directionFromTUN, protocol, len(buf))
+			handled, err := m.replyToICMPEcho(tun, protocol, bufs[i], readOffset, sizes[i])
+			if err != nil {
+				return trace.Wrap(err, "writing ICMP echo reply to TUN")
+			}
+			if handled {
+				continue
+			}
 			packet := stack.NewPacketBuffer(stack.PacketBufferOptions{
-				Payload: buffer.MakeWithData(bufs[i][readOffset : readOffset+sizes[i]]),
+				Payload: buffer.MakeWithData(buf),
 			})
 			linkEndpoint.InjectInbound(protocol, packet)
 			packet.DecRef()
@@ -429,6 +708,108 @@ func forwardTUNtoNetstack(tun TUNDevice, linkEndpoint *channel.Endpoint) error {
 	}
 }
 
+// replyToICMPEcho checks whether the packet at [writeBuf][offset:offset+packetLen] (a full IP packet read
+// from the TUN) is an ICMP Echo Request destined to an address currently assigned in the VNet, and if so
+// rewrites it into an Echo Reply in place and writes it straight back to [tun], without ever involving the
+// gVisor netstack or a socket. It returns true if the packet was handled and should not be passed on to the
+// netstack. The rewrite and write-back happen synchronously, before [writeBuf]'s backing array is reused by
+// the next call to [TUNDevice.Read], so the reply never races with that reuse.
+func (m *Manager) replyToICMPEcho(tun TUNDevice, protocol tcpip.NetworkProtocolNumber, writeBuf []byte, offset, packetLen int) (bool, error) {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		return m.replyToICMPv4Echo(tun, writeBuf, offset, packetLen)
+	case header.IPv6ProtocolNumber:
+		return m.replyToICMPv6Echo(tun, writeBuf, offset, packetLen)
+	}
+	return false, nil
+}
+
+func (m *Manager) replyToICMPv4Echo(tun TUNDevice, writeBuf []byte, offset, packetLen int) (bool, error) {
+	buf := writeBuf[offset : offset+packetLen]
+	ipHdr := header.IPv4(buf)
+	if !ipHdr.IsValid(len(buf)) || ipHdr.TransportProtocol() != header.ICMPv4ProtocolNumber {
+		return false, nil
+	}
+	icmpHdr := header.ICMPv4(ipHdr.Payload())
+	if len(icmpHdr) < header.ICMPv4MinimumSize {
+		return false, nil
+	}
+	if icmpHdr.Type() != header.ICMPv4Echo {
+		return false, nil
+	}
+	dst, src := ipHdr.DestinationAddress(), ipHdr.SourceAddress()
+	if !m.hasAssignedAddress(dst) {
+		return false, nil
+	}
+
+	icmpHdr.SetType(header.ICMPv4EchoReply)
+	icmpHdr.SetChecksum(0)
+	icmpHdr.SetChecksum(^header.Checksum(icmpHdr, 0))
+
+	ipHdr.SetSourceAddress(dst)
+	ipHdr.SetDestinationAddress(src)
+	ipHdr.SetChecksum(0)
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+
+	_, err := tun.Write([][]byte{writeBuf[:offset+packetLen]}, offset)
+	m.metrics.recordTUNPacket(directionToTUN, header.IPv4ProtocolNumber, packetLen)
+	return true, trace.Wrap(err)
+}
+
+func (m *Manager) replyToICMPv6Echo(tun TUNDevice, writeBuf []byte, offset, packetLen int) (bool, error) {
+	buf := writeBuf[offset : offset+packetLen]
+	ipHdr := header.IPv6(buf)
+	if !ipHdr.IsValid(len(buf)) || ipHdr.TransportProtocol() != header.ICMPv6ProtocolNumber {
+		return false, nil
+	}
+	icmpHdr := header.ICMPv6(ipHdr.Payload())
+	if len(icmpHdr) < header.ICMPv6MinimumSize {
+		return false, nil
+	}
+	if icmpHdr.Type() != header.ICMPv6EchoRequest {
+		return false, nil
+	}
+	dst, src := ipHdr.DestinationAddress(), ipHdr.SourceAddress()
+	if !m.hasAssignedAddress(dst) {
+		return false, nil
+	}
+
+	icmpHdr.SetType(header.ICMPv6EchoReply)
+	icmpHdr.SetChecksum(0)
+	icmpHdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: icmpHdr,
+		Src:    dst,
+		Dst:    src,
+	}))
+
+	ipHdr.SetSourceAddress(dst)
+	ipHdr.SetDestinationAddress(src)
+
+	_, err := tun.Write([][]byte{writeBuf[:offset+packetLen]}, offset)
+	m.metrics.recordTUNPacket(directionToTUN, header.IPv6ProtocolNumber, packetLen)
+	return true, trace.Wrap(err)
+}
+
+// hasAssignedAddress reports whether [addr] is an address currently reachable in the VNet: either the NIC's
+// own reserved address within [m.ipv6Prefix], or an address assigned to a TCP or UDP handler.
+func (m *Manager) hasAssignedAddress(addr tcpip.Address) bool {
+	if addr == ipv6WithSuffix(m.ipv6Prefix, u32ToBytes(1)) {
+		return true
+	}
+	m.state.mu.RLock()
+	defer m.state.mu.RUnlock()
+	if _, ok := m.state.tcpHandlers[addr]; ok {
+		return true
+	}
+	if _, ok := m.state.tcpHandlersV4[addr]; ok {
+		return true
+	}
+	if _, ok := m.state.udpHandlers[addr]; ok {
+		return true
+	}
+	return false
+}
+
 func (m *Manager) addProtocolAddress(localAddress tcpip.Address) error {
 	protocolAddress, err := protocolAddress(localAddress)
 	if err != nil {
@@ -467,6 +848,19 @@ func protocolVersion(b byte) (tcpip.NetworkProtocolNumber, bool) {
 	return 0, false
 }
 
+// ipv4WithSuffix returns the address [ipv4Net.IP]+suffix, as a /32 allocated out of [ipv4Net]. It returns an
+// error if the pool of addresses in [ipv4Net] is exhausted.
+func ipv4WithSuffix(ipv4Net *net.IPNet, suffix uint32) (tcpip.Address, error) {
+	ones, bits := ipv4Net.Mask.Size()
+	if hostBits := bits - ones; hostBits < 32 && suffix>>uint(hostBits) != 0 {
+		return tcpip.Address{}, trace.LimitExceeded("exhausted IPv4 address pool %s", ipv4Net)
+	}
+	addr := binary.BigEndian.Uint32(ipv4Net.IP.To4()) + suffix
+	var addrBytes [4]byte
+	binary.BigEndian.PutUint32(addrBytes[:], addr)
+	return tcpip.AddrFrom4(addrBytes), nil
+}
+
 func ipv6WithSuffix(prefix tcpip.Address, suffix []byte) tcpip.Address {
 	addrBytes := prefix.As16()
 	offset := len(addrBytes) - len(suffix)